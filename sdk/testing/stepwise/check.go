@@ -0,0 +1,160 @@
+package stepwise
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// CheckMulti combines multiple StepCheckFuncs into a single StepCheckFunc,
+// short-circuiting on the first one that returns an error.
+func CheckMulti(fns ...StepCheckFunc) StepCheckFunc {
+	return func(resp *api.Secret, err error) error {
+		for _, fn := range fns {
+			if chkErr := fn(resp, err); chkErr != nil {
+				return chkErr
+			}
+		}
+		return nil
+	}
+}
+
+// CheckAuthPolicies asserts that the response's Auth block carries exactly
+// the given set of policies, in any order.
+func CheckAuthPolicies(policies []string) StepCheckFunc {
+	return func(resp *api.Secret, err error) error {
+		if err != nil {
+			return err
+		}
+		if resp == nil || resp.Auth == nil {
+			return fmt.Errorf("no auth in response")
+		}
+
+		expected := make([]string, len(policies))
+		copy(expected, policies)
+		sort.Strings(expected)
+
+		actual := make([]string, len(resp.Auth.Policies))
+		copy(actual, resp.Auth.Policies)
+		sort.Strings(actual)
+
+		if !reflect.DeepEqual(actual, expected) {
+			return fmt.Errorf("invalid policies: expected %#v, got %#v", expected, actual)
+		}
+		return nil
+	}
+}
+
+// CheckAuthDisplayName asserts that the response's Auth block has the
+// display name "mnt-" + n. An empty n skips the check.
+func CheckAuthDisplayName(n string) StepCheckFunc {
+	return func(resp *api.Secret, err error) error {
+		if err != nil {
+			return err
+		}
+		if resp == nil || resp.Auth == nil {
+			return fmt.Errorf("no auth in response")
+		}
+		if n != "" && resp.Auth.DisplayName != "mnt-"+n {
+			return fmt.Errorf("invalid display name: %#v", resp.Auth.DisplayName)
+		}
+		return nil
+	}
+}
+
+// CheckData deep-compares the given keys of resp.Data against expected
+// values. Keys in resp.Data that aren't present in expected are ignored.
+func CheckData(expected map[string]interface{}) StepCheckFunc {
+	return func(resp *api.Secret, err error) error {
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return fmt.Errorf("no response to check data against")
+		}
+		for k, v := range expected {
+			actual, ok := resp.Data[k]
+			if !ok {
+				return fmt.Errorf("missing data key %q", k)
+			}
+			if !reflect.DeepEqual(actual, v) {
+				return fmt.Errorf("data key %q: expected %#v, got %#v", k, v, actual)
+			}
+		}
+		return nil
+	}
+}
+
+// CheckDataKeys asserts that every given key is present in resp.Data,
+// without making any claim about their values.
+func CheckDataKeys(keys ...string) StepCheckFunc {
+	return func(resp *api.Secret, err error) error {
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return fmt.Errorf("no response to check data against")
+		}
+		for _, k := range keys {
+			if _, ok := resp.Data[k]; !ok {
+				return fmt.Errorf("missing data key %q", k)
+			}
+		}
+		return nil
+	}
+}
+
+// CheckLeaseDuration asserts that the response's lease duration falls
+// within [min, max].
+func CheckLeaseDuration(min, max time.Duration) StepCheckFunc {
+	return func(resp *api.Secret, err error) error {
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return fmt.Errorf("no response to check lease duration against")
+		}
+		actual := time.Duration(resp.LeaseDuration) * time.Second
+		if actual < min || actual > max {
+			return fmt.Errorf("lease duration %s out of range [%s, %s]", actual, min, max)
+		}
+		return nil
+	}
+}
+
+// CheckRenewable asserts that the response's Renewable flag matches
+// expected.
+func CheckRenewable(expected bool) StepCheckFunc {
+	return func(resp *api.Secret, err error) error {
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return fmt.Errorf("no response to check renewable against")
+		}
+		if resp.Renewable != expected {
+			return fmt.Errorf("expected renewable=%t, got %t", expected, resp.Renewable)
+		}
+		return nil
+	}
+}
+
+// CheckErrorContains asserts that err is non-nil and that its message
+// contains substr, e.g. logical.ErrPermissionDenied.Error().
+func CheckErrorContains(substr string) StepCheckFunc {
+	return func(resp *api.Secret, err error) error {
+		if err == nil {
+			return fmt.Errorf("expected error containing %q, got no error", substr)
+		}
+		if !errwrap.Contains(err, substr) && !strings.Contains(err.Error(), substr) {
+			return fmt.Errorf("expected error containing %q, got: %s", substr, err)
+		}
+		return nil
+	}
+}
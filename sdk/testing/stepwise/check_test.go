@@ -0,0 +1,178 @@
+package stepwise
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestCheckMulti(t *testing.T) {
+	var called []int
+	track := func(n int, err error) StepCheckFunc {
+		return func(*api.Secret, error) error {
+			called = append(called, n)
+			return err
+		}
+	}
+
+	t.Run("all pass", func(t *testing.T) {
+		called = nil
+		check := CheckMulti(track(1, nil), track(2, nil), track(3, nil))
+		if err := check(nil, nil); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if len(called) != 3 {
+			t.Fatalf("expected all 3 checks to run, got %#v", called)
+		}
+	})
+
+	t.Run("short-circuits on first error", func(t *testing.T) {
+		called = nil
+		boom := errors.New("boom")
+		check := CheckMulti(track(1, nil), track(2, boom), track(3, nil))
+		if err := check(nil, nil); err != boom {
+			t.Fatalf("expected boom, got %v", err)
+		}
+		if len(called) != 2 {
+			t.Fatalf("expected check 3 to be skipped, got %#v", called)
+		}
+	})
+}
+
+func TestCheckAuthPolicies(t *testing.T) {
+	cases := map[string]struct {
+		resp      *api.Secret
+		policies  []string
+		expectErr bool
+	}{
+		"matching, different order": {
+			resp:     &api.Secret{Auth: &api.SecretAuth{Policies: []string{"b", "a"}}},
+			policies: []string{"a", "b"},
+		},
+		"missing auth": {
+			resp:      &api.Secret{},
+			policies:  []string{"a"},
+			expectErr: true,
+		},
+		"mismatched policies": {
+			resp:      &api.Secret{Auth: &api.SecretAuth{Policies: []string{"a"}}},
+			policies:  []string{"a", "b"},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := CheckAuthPolicies(tc.policies)(tc.resp, nil)
+			if tc.expectErr && err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			if !tc.expectErr && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestCheckAuthDisplayName(t *testing.T) {
+	resp := &api.Secret{Auth: &api.SecretAuth{DisplayName: "mnt-carl"}}
+
+	if err := CheckAuthDisplayName("carl")(resp, nil); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if err := CheckAuthDisplayName("")(resp, nil); err != nil {
+		t.Fatalf("empty name should skip the check, got %s", err)
+	}
+	if err := CheckAuthDisplayName("nope")(resp, nil); err == nil {
+		t.Fatal("expected an error for mismatched display name")
+	}
+	if err := CheckAuthDisplayName("carl")(&api.Secret{}, nil); err == nil {
+		t.Fatal("expected an error when there is no auth block")
+	}
+}
+
+func TestCheckData(t *testing.T) {
+	resp := &api.Secret{Data: map[string]interface{}{
+		"foo":   "bar",
+		"extra": "ignored",
+	}}
+
+	t.Run("ignores keys not in expected", func(t *testing.T) {
+		if err := CheckData(map[string]interface{}{"foo": "bar"})(resp, nil); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+	})
+
+	t.Run("mismatched value", func(t *testing.T) {
+		if err := CheckData(map[string]interface{}{"foo": "baz"})(resp, nil); err == nil {
+			t.Fatal("expected an error for mismatched value")
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		if err := CheckData(map[string]interface{}{"missing": "x"})(resp, nil); err == nil {
+			t.Fatal("expected an error for missing key")
+		}
+	})
+}
+
+func TestCheckDataKeys(t *testing.T) {
+	resp := &api.Secret{Data: map[string]interface{}{"foo": "bar"}}
+
+	if err := CheckDataKeys("foo")(resp, nil); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if err := CheckDataKeys("foo", "missing")(resp, nil); err == nil {
+		t.Fatal("expected an error for missing key")
+	}
+}
+
+func TestCheckLeaseDuration(t *testing.T) {
+	cases := map[string]struct {
+		duration  int
+		min, max  time.Duration
+		expectErr bool
+	}{
+		"within range": {duration: 30, min: 10 * time.Second, max: 60 * time.Second},
+		"at min bound": {duration: 10, min: 10 * time.Second, max: 60 * time.Second},
+		"at max bound": {duration: 60, min: 10 * time.Second, max: 60 * time.Second},
+		"below range":  {duration: 5, min: 10 * time.Second, max: 60 * time.Second, expectErr: true},
+		"above range":  {duration: 61, min: 10 * time.Second, max: 60 * time.Second, expectErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			resp := &api.Secret{LeaseDuration: tc.duration}
+			err := CheckLeaseDuration(tc.min, tc.max)(resp, nil)
+			if tc.expectErr && err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			if !tc.expectErr && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestCheckRenewable(t *testing.T) {
+	if err := CheckRenewable(true)(&api.Secret{Renewable: true}, nil); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if err := CheckRenewable(false)(&api.Secret{Renewable: true}, nil); err == nil {
+		t.Fatal("expected an error for mismatched renewable flag")
+	}
+}
+
+func TestCheckErrorContains(t *testing.T) {
+	if err := CheckErrorContains("permission denied")(nil, errors.New("1 error occurred: permission denied")); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if err := CheckErrorContains("permission denied")(nil, errors.New("not found")); err == nil {
+		t.Fatal("expected an error when the substring is absent")
+	}
+	if err := CheckErrorContains("permission denied")(nil, nil); err == nil {
+		t.Fatal("expected an error when there is no error to check")
+	}
+}
@@ -0,0 +1,193 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	docker "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// dockerImage is the pinned Vault release used by DockerDriver so that
+	// acceptance runs are reproducible regardless of what's on the host.
+	// Override via DockerDriver.Image/Tag to test against another release.
+	dockerImage = "vault"
+	dockerTag   = "1.5.0"
+
+	dockerDevRootToken = "stepwise-root"
+	dockerDevPort      = "8200/tcp"
+
+	healthCheckTimeout = 30 * time.Second
+)
+
+// DockerDriver fulfills the stepwise.StepDriver interface by running a real
+// Vault release binary, in "-dev" mode, inside a Docker container. It is
+// slower than InmemDriver but exercises the actual binary, which matters
+// for acceptance tests that need to run against more than one Vault
+// version.
+type DockerDriver struct {
+	// MountName is the path the backend under test is mounted at, e.g.
+	// "transit".
+	MountName string
+
+	// Options describes how the backend under test should be mounted.
+	Options *api.MountInput
+
+	// Image and Tag override the pinned default Vault image, e.g. to test
+	// against a specific release.
+	Image string
+	Tag   string
+
+	dockerAPI   *dockerclient.Client
+	containerID string
+	client      *api.Client
+}
+
+// NewDockerDriver returns a DockerDriver that will mount the backend under
+// test at mountName using the provided options once Setup is called.
+func NewDockerDriver(mountName string, options *api.MountInput) *DockerDriver {
+	return &DockerDriver{
+		MountName: mountName,
+		Options:   options,
+	}
+}
+
+// Name implements stepwise.StepDriver.
+func (d *DockerDriver) Name() string {
+	return "docker"
+}
+
+// Setup pulls the pinned Vault image, starts it in dev mode on a random
+// host port, and waits for it to report healthy before returning. Mounting
+// the backend under test is left to stepwise.Run, which calls
+// MountPath/MountOptions after Setup succeeds.
+func (d *DockerDriver) Setup() error {
+	image := d.Image
+	if image == "" {
+		image = dockerImage
+	}
+	tag := d.Tag
+	if tag == "" {
+		tag = dockerTag
+	}
+	ref := fmt.Sprintf("%s:%s", image, tag)
+
+	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("error creating docker client: %w", err)
+	}
+	d.dockerAPI = cli
+
+	ctx := context.Background()
+
+	pullResp, err := cli.ImagePull(ctx, ref, docker.ImagePullOptions{})
+	if err != nil {
+		return fmt.Errorf("error pulling %q: %w", ref, err)
+	}
+	defer pullResp.Close()
+	if _, err := io.Copy(ioutil.Discard, pullResp); err != nil {
+		return fmt.Errorf("error reading image pull response: %w", err)
+	}
+
+	containerCfg := &container.Config{
+		Image: ref,
+		Env:   []string{"VAULT_DEV_ROOT_TOKEN_ID=" + dockerDevRootToken},
+		Cmd:   []string{"server", "-dev", "-dev-listen-address=0.0.0.0:8200"},
+		ExposedPorts: nat.PortSet{
+			dockerDevPort: {},
+		},
+	}
+	hostCfg := &container.HostConfig{
+		PortBindings: nat.PortMap{
+			dockerDevPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "0"}},
+		},
+		AutoRemove: true,
+	}
+
+	created, err := cli.ContainerCreate(ctx, containerCfg, hostCfg, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("error creating container from %q: %w", ref, err)
+	}
+	d.containerID = created.ID
+
+	if err := cli.ContainerStart(ctx, d.containerID, docker.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("error starting container: %w", err)
+	}
+
+	inspect, err := cli.ContainerInspect(ctx, d.containerID)
+	if err != nil {
+		return fmt.Errorf("error inspecting container: %w", err)
+	}
+	bindings := inspect.NetworkSettings.Ports[dockerDevPort]
+	if len(bindings) == 0 {
+		return fmt.Errorf("no host port bound for %s", dockerDevPort)
+	}
+	addr := fmt.Sprintf("http://127.0.0.1:%s", bindings[0].HostPort)
+
+	client, err := api.NewClient(&api.Config{Address: addr})
+	if err != nil {
+		return fmt.Errorf("error creating client for %s: %w", addr, err)
+	}
+	client.SetToken(dockerDevRootToken)
+	d.client = client
+
+	if err := d.waitForHealthy(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// waitForHealthy polls /v1/sys/health until Vault answers or
+// healthCheckTimeout elapses.
+func (d *DockerDriver) waitForHealthy() error {
+	deadline := time.Now().Add(healthCheckTimeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		if _, err := d.client.Sys().Health(); err == nil {
+			return nil
+		} else {
+			lastErr = err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("vault container did not become healthy within %s: %w", healthCheckTimeout, lastErr)
+}
+
+// Client implements stepwise.StepDriver.
+func (d *DockerDriver) Client() (*api.Client, error) {
+	if d.client == nil {
+		return nil, fmt.Errorf("docker driver has not been set up yet")
+	}
+	return d.client, nil
+}
+
+// MountPath implements stepwise.StepDriver.
+func (d *DockerDriver) MountPath() string {
+	return d.MountName
+}
+
+// MountOptions implements stepwise.StepDriver.
+func (d *DockerDriver) MountOptions() *api.MountInput {
+	return d.Options
+}
+
+// Teardown stops and removes the container started in Setup.
+func (d *DockerDriver) Teardown() error {
+	if d.dockerAPI == nil || d.containerID == "" {
+		return nil
+	}
+	timeout := 5 * time.Second
+	if err := d.dockerAPI.ContainerStop(context.Background(), d.containerID, &timeout); err != nil {
+		return fmt.Errorf("error stopping container %s: %w", d.containerID, err)
+	}
+	return nil
+}
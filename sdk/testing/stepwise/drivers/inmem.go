@@ -0,0 +1,108 @@
+// Package drivers contains StepDriver implementations for use with
+// stepwise.Run.
+package drivers
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/go-testing-interface"
+
+	"github.com/hashicorp/vault/api"
+	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/sdk/helper/namespace"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/vault"
+)
+
+// InmemDriver fulfills the stepwise.StepDriver interface by standing up an
+// in-process, unsealed Vault test cluster and talking to it over the
+// cluster's loopback listener. It is the fastest driver available and should be
+// preferred unless a test specifically needs to exercise a real Vault
+// release binary, in which case use DockerDriver instead.
+type InmemDriver struct {
+	// MountName is the path the backend under test is mounted at, e.g.
+	// "transit".
+	MountName string
+
+	// Options describes how the backend under test should be mounted.
+	Options *api.MountInput
+
+	t       testing.T
+	cluster *vault.TestCluster
+	core    *vault.TestClusterCore
+	client  *api.Client
+}
+
+// NewInmemDriver returns an InmemDriver that will mount the backend under
+// test at mountName using the provided options once Setup is called.
+func NewInmemDriver(t testing.T, mountName string, options *api.MountInput) *InmemDriver {
+	return &InmemDriver{
+		t:         t,
+		MountName: mountName,
+		Options:   options,
+	}
+}
+
+// Name implements stepwise.StepDriver.
+func (d *InmemDriver) Name() string {
+	return "inmem"
+}
+
+// Setup spins up an in-memory, unsealed Vault core and points Client() at
+// it. Mounting the backend under test is left to stepwise.Run, which calls
+// MountPath/MountOptions after Setup succeeds.
+func (d *InmemDriver) Setup() error {
+	cluster := vault.NewTestCluster(d.t, nil, &vault.TestClusterOptions{
+		HandlerFunc: vaulthttp.Handler,
+		NumCores:    1,
+	})
+	cluster.Start()
+	d.cluster = cluster
+
+	core := cluster.Cores[0]
+	vault.TestWaitActive(d.t, core.Core)
+	d.core = core
+
+	client := core.Client
+	client.SetToken(cluster.RootToken)
+	d.client = client
+
+	return nil
+}
+
+// Client implements stepwise.StepDriver.
+func (d *InmemDriver) Client() (*api.Client, error) {
+	if d.client == nil {
+		return nil, fmt.Errorf("inmem driver has not been set up yet")
+	}
+	return d.client, nil
+}
+
+// MountPath implements stepwise.StepDriver.
+func (d *InmemDriver) MountPath() string {
+	return d.MountName
+}
+
+// MountOptions implements stepwise.StepDriver.
+func (d *InmemDriver) MountOptions() *api.MountInput {
+	return d.Options
+}
+
+// Teardown implements stepwise.StepDriver.
+func (d *InmemDriver) Teardown() error {
+	if d.cluster == nil {
+		return nil
+	}
+	// Cleanup, not just Core.Shutdown, so the cluster's test HTTP
+	// listeners and temp cert/dir state from NewTestCluster are torn
+	// down too.
+	d.cluster.Cleanup()
+	return nil
+}
+
+// HandleRequest satisfies stepwise's rollbackDriver interface, letting Run
+// issue a RollbackOperation directly against the core -- something there's
+// no public HTTP endpoint for.
+func (d *InmemDriver) HandleRequest(req *logical.Request) (*logical.Response, error) {
+	return d.core.Core.HandleRequest(namespace.RootContext(nil), req)
+}
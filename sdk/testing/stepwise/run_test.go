@@ -0,0 +1,236 @@
+package stepwise
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func init() {
+	// Run requires -test.v unless this is set; the fake TestT below isn't
+	// a real *testing.T, so there's no verbose flag for it to check.
+	testTesting = true
+}
+
+// fakeTT is a TestT that records Error/Fatal calls instead of acting on
+// them, so Run's retry/ErrorOk/PreFlight/Namespace logic can be exercised
+// without a real testing.T (whose Fatal would runtime.Goexit the whole
+// test function).
+type fakeTT struct {
+	errors []string
+	fatal  string
+}
+
+func (f *fakeTT) Error(args ...interface{}) { f.errors = append(f.errors, fmt.Sprint(args...)) }
+func (f *fakeTT) Fatal(args ...interface{}) { f.fatal = fmt.Sprint(args...); panic(fakeTTStop{}) }
+func (f *fakeTT) Skip(args ...interface{})  { panic(fakeTTStop{}) }
+func (f *fakeTT) Helper()                   {}
+
+// fakeTTStop is the panic value fakeTT.Fatal/Skip use to unwind out of Run
+// the same way runtime.Goexit would for a real *testing.T.
+type fakeTTStop struct{}
+
+// runCase runs c against tt, recovering the fakeTTStop panic used to model
+// tt.Fatal/tt.Skip.
+func runCase(tt *fakeTT, c Case) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(fakeTTStop); !ok {
+				panic(r)
+			}
+		}
+	}()
+	Run(tt, c)
+}
+
+// scriptedResponse is one canned HTTP response a scriptedHandler can play
+// back for a logical request.
+type scriptedResponse struct {
+	status int
+	body   string
+}
+
+// scriptedHandler fakes just enough of Vault's HTTP API for Run to drive a
+// Step against it: it always accepts the sys/mounts call Run issues after
+// Driver.Setup, and otherwise plays back a fixed script of responses for
+// the backend request, repeating the last entry once exhausted.
+type scriptedHandler struct {
+	mu        sync.Mutex
+	calls     int
+	responses []scriptedResponse
+}
+
+func (h *scriptedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == http.MethodPut || r.Method == http.MethodPost) && strings.HasPrefix(r.URL.Path, "/v1/sys/mounts/") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h.mu.Lock()
+	idx := h.calls
+	if idx >= len(h.responses) {
+		idx = len(h.responses) - 1
+	}
+	resp := h.responses[idx]
+	h.calls++
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	w.Write([]byte(resp.body))
+}
+
+func (h *scriptedHandler) callCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+// fakeDriver is a minimal StepDriver backed by a scriptedHandler, for
+// exercising Run without a real Vault backend.
+type fakeDriver struct {
+	client       *api.Client
+	teardownHits int
+}
+
+func newFakeDriver(t *testing.T, handler http.Handler) *fakeDriver {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatalf("error creating fake client: %s", err)
+	}
+	client.SetToken("root")
+
+	return &fakeDriver{client: client}
+}
+
+func (d *fakeDriver) Setup() error                  { return nil }
+func (d *fakeDriver) Teardown() error               { d.teardownHits++; return nil }
+func (d *fakeDriver) Client() (*api.Client, error)  { return d.client, nil }
+func (d *fakeDriver) Name() string                  { return "fake" }
+func (d *fakeDriver) MountPath() string             { return "fake" }
+func (d *fakeDriver) MountOptions() *api.MountInput { return &api.MountInput{Type: "fake"} }
+
+// TestRun_RetryPolicy_ErrorOk ensures a Step that is expected to fail
+// (ErrorOk) and whose Check already passes on the first attempt doesn't
+// keep retrying for the rest of RetryPolicy.Timeout just because the raw
+// request returned a non-nil error.
+func TestRun_RetryPolicy_ErrorOk(t *testing.T) {
+	handler := &scriptedHandler{
+		responses: []scriptedResponse{
+			{status: http.StatusForbidden, body: `{"errors":["permission denied"]}`},
+		},
+	}
+	driver := newFakeDriver(t, handler)
+
+	tt := &fakeTT{}
+	runCase(tt, Case{
+		Driver: driver,
+		Steps: []Step{
+			{
+				Operation: ReadOperation,
+				Path:      "denied",
+				ErrorOk:   true,
+				Check: func(resp *api.Secret, err error) error {
+					if err == nil || !strings.Contains(err.Error(), "permission denied") {
+						return fmt.Errorf("expected a permission denied error, got: %v", err)
+					}
+					return nil
+				},
+				RetryPolicy: &RetryPolicy{
+					Timeout:  200 * time.Millisecond,
+					Interval: 5 * time.Millisecond,
+				},
+			},
+		},
+	})
+
+	if len(tt.errors) != 0 {
+		t.Fatalf("expected no errors, got %#v", tt.errors)
+	}
+	if tt.fatal != "" {
+		t.Fatalf("expected no fatal, got %q", tt.fatal)
+	}
+	if got := handler.callCount(); got != 1 {
+		t.Fatalf("expected exactly 1 request (no retry spin), got %d", got)
+	}
+	if driver.teardownHits != 1 {
+		t.Fatalf("expected Teardown to run exactly once, got %d", driver.teardownHits)
+	}
+}
+
+// TestRun_RetryPolicy_EventuallySucceeds ensures a Step without ErrorOk
+// keeps retrying an unexpected error until the underlying condition
+// clears, which is the core use case RetryPolicy exists for.
+func TestRun_RetryPolicy_EventuallySucceeds(t *testing.T) {
+	handler := &scriptedHandler{
+		responses: []scriptedResponse{
+			{status: http.StatusServiceUnavailable, body: `{"errors":["plugin not yet mounted"]}`},
+			{status: http.StatusServiceUnavailable, body: `{"errors":["plugin not yet mounted"]}`},
+			{status: http.StatusOK, body: `{"data":{"ok":true}}`},
+		},
+	}
+	driver := newFakeDriver(t, handler)
+
+	tt := &fakeTT{}
+	runCase(tt, Case{
+		Driver: driver,
+		Steps: []Step{
+			{
+				Operation: ReadOperation,
+				Path:      "eventually",
+				RetryPolicy: &RetryPolicy{
+					Timeout:  1 * time.Second,
+					Interval: 5 * time.Millisecond,
+				},
+			},
+		},
+	})
+
+	if len(tt.errors) != 0 {
+		t.Fatalf("expected no errors, got %#v", tt.errors)
+	}
+	if tt.fatal != "" {
+		t.Fatalf("expected no fatal, got %q", tt.fatal)
+	}
+	if got := handler.callCount(); got != 3 {
+		t.Fatalf("expected exactly 3 requests, got %d", got)
+	}
+}
+
+// TestRun_RetryPolicy_ZeroIntervalDoesNotPanic ensures an easy-to-make
+// mistake -- a RetryPolicy with Interval left at its zero value -- fails
+// the step cleanly instead of panicking the whole run via
+// time.NewTicker(0).
+func TestRun_RetryPolicy_ZeroIntervalDoesNotPanic(t *testing.T) {
+	handler := &scriptedHandler{
+		responses: []scriptedResponse{
+			{status: http.StatusServiceUnavailable, body: `{"errors":["nope"]}`},
+		},
+	}
+	driver := newFakeDriver(t, handler)
+
+	tt := &fakeTT{}
+	runCase(tt, Case{
+		Driver: driver,
+		Steps: []Step{
+			{
+				Operation:   ReadOperation,
+				Path:        "zero-interval",
+				RetryPolicy: &RetryPolicy{Timeout: 20 * time.Millisecond},
+			},
+		},
+	})
+
+	if tt.fatal != "" {
+		t.Fatalf("expected no panic/fatal, got %q", tt.fatal)
+	}
+}
@@ -4,11 +4,14 @@ package stepwise
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/errwrap"
 	log "github.com/hashicorp/go-hclog"
 	"github.com/y0ssar1an/q"
 
@@ -57,19 +60,68 @@ type Step struct {
 	Check StepCheckFunc
 
 	// PreFlight is called directly before execution of the request, allowing
-	// modification of the request parameters (e.g. Path) with dynamic values.
-	// PreFlight PreFlightFunc
+	// modification of the request parameters (e.g. Path, Data) with dynamic
+	// values that are only known at runtime, such as a token minted by an
+	// earlier step or a generated secret path.
+	PreFlight PreFlightFunc
 
 	// ErrorOk, if true, will let erroneous responses through to the check
 	ErrorOk bool
 
 	// Unauthenticated, if true, will make the request unauthenticated.
 	Unauthenticated bool
+
+	// RetryPolicy, if set, overrides the Case's RetryPolicy for this step.
+	// Use it when a step races against something eventually consistent,
+	// e.g. a rotated key eventually appearing, or a revoked token
+	// eventually returning a 403.
+	RetryPolicy *RetryPolicy
+
+	// Namespace, if set, scopes the step's request to the given Vault
+	// Enterprise namespace.
+	Namespace string
+
+	// Headers, if set, are added to the step's request.
+	Headers map[string][]string
+
+	// Policies, if non-empty, causes Run to mint a child token carrying
+	// exactly these policies (via the driver's root client) and issue the
+	// step's request with that token instead of the driver's root token.
+	// The child token is revoked during teardown. Combine with
+	// Unauthenticated across a Case's steps to exercise a full matrix of
+	// auth contexts, e.g. "a limited-use token should fail on second use".
+	Policies []string
+}
+
+// RetryPolicy configures how long, and how often, a Step's operation and
+// Check are retried before the step is considered failed. Vault acceptance
+// tests frequently race against async replication, lease revocation
+// propagation, and plugin startup, so a single failed attempt doesn't
+// necessarily mean the step is wrong.
+type RetryPolicy struct {
+	// Timeout bounds the total time spent retrying before the step fails.
+	Timeout time.Duration
+
+	// Interval is how long to wait between attempts. Defaults to 1 second
+	// if left at its zero value, since a zero Interval would otherwise
+	// panic time.NewTicker.
+	Interval time.Duration
+
+	// RetryOn decides whether a given response/error pair is worth
+	// retrying. If nil, an attempt is retried when its operation returns an
+	// error and the step doesn't set ErrorOk, or when its Check returns a
+	// non-nil error.
+	RetryOn func(*api.Secret, error) bool
 }
 
 // StepCheckFunc is the callback used for Check in TestStep.
 type StepCheckFunc func(*api.Secret, error) error
 
+// PreFlightFunc is the callback used for PreFlight in Step. It runs
+// immediately before the step's request is issued, and may mutate the
+// passed-in Step in place.
+type PreFlightFunc func(*api.Client, *Step) error
+
 // StepDriver is the interface Drivers need to implement to be used in
 // Case to execute each Step
 type StepDriver interface {
@@ -77,6 +129,15 @@ type StepDriver interface {
 	Client() (*api.Client, error)
 	Teardown() error
 	Name() string // maybe?
+
+	// MountPath is the path the backend under test should be mounted at,
+	// e.g. "transit". Run prefixes every Step's Path with this value.
+	MountPath() string
+
+	// MountOptions describes how the backend under test should be mounted
+	// (type, plugin name, config, etc). Run calls this once, right after
+	// Setup, to perform the mount against the driver's client.
+	MountOptions() *api.MountInput
 }
 
 // Case is a single set of tests to run for a backend. A test Case
@@ -93,6 +154,10 @@ type Case struct {
 	// Steps are the set of operations that are run for this test case.
 	Steps []Step
 
+	// RetryPolicy is the default retry policy used for any Step that
+	// doesn't set its own.
+	RetryPolicy *RetryPolicy
+
 	// Teardown will be called before the test case is over regardless
 	// of if the test succeeded or failed. This should return an error
 	// in the case that the test can't guarantee all resources were
@@ -164,6 +229,17 @@ func Run(tt TestT, c Case) {
 			c.Driver.Teardown()
 			tt.Fatal(err)
 		}
+		// Defer the matching Teardown as soon as Setup succeeds, rather
+		// than relying on a plain call at the bottom of Run. Drivers can
+		// own real, expensive resources (a running Docker container, an
+		// unsealed vault.TestCluster), and any tt.Fatal further down --
+		// e.g. a failed Mount, or token creation for a Policies step --
+		// would otherwise Goexit past that call and leak them.
+		defer func() {
+			if err := c.Driver.Teardown(); err != nil {
+				tt.Fatal(err)
+			}
+		}()
 	} else {
 		tt.Fatal("nil driver in acceptance test")
 	}
@@ -172,161 +248,238 @@ func Run(tt TestT, c Case) {
 	// TODO use test logger if available?
 	logger := logging.NewVaultLogger(log.Trace)
 
+	// Mount the backend under test at the path the driver wants it at. This
+	// replaces the old hardcoded "transit/" prefix so the same Run loop can
+	// drive acceptance tests for any backend, against any driver.
+	mountClient, cerr := c.Driver.Client()
+	if cerr != nil {
+		tt.Fatal(cerr)
+	}
+	if err := mountClient.Sys().Mount(c.Driver.MountPath(), c.Driver.MountOptions()); err != nil {
+		tt.Fatal(fmt.Sprintf("error mounting %q: %s", c.Driver.MountPath(), err))
+	}
+
 	// Steps here
 	// Make requests
-	var revoke []*logical.Request
+	var revoke []*api.Secret
+	var revokeTokens []string
 	for i, s := range c.Steps {
 		q.Q("==> step:", s)
 		if logger.IsWarn() {
 			logger.Warn("Executing test step", "step_number", i+1)
 		}
 
-		// TODO hard coded path here, need mount point. Will it be dynamic? probabaly
-		// needs to be
-		path := fmt.Sprintf("transit/%s", s.Path)
-		var err error
-		var resp *api.Secret
-		client, cerr := c.Driver.Client()
+		rootClient, cerr := c.Driver.Client()
 		if cerr != nil {
 			tt.Fatal(cerr)
 		}
-		// TODO should check expect none here?
-		// var lr *logical.Response
-		switch s.Operation {
-		case WriteOperation, UpdateOperation:
-			q.Q("===> Write/Update operation")
-			resp, err = client.Logical().Write(path, s.Data)
-		case ReadOperation:
-			q.Q("===> Read operation")
-			// resp, err = client.Logical().ReadWithData(path, s.Data)
-			resp, err = client.Logical().Read(path)
-		case ListOperation:
-			q.Q("===> List operation")
-			resp, err = client.Logical().List(path)
-		case DeleteOperation:
-			q.Q("===> Delete operation")
-			resp, err = client.Logical().Delete(path)
-		default:
-			panic("bad operation")
+
+		if s.PreFlight != nil {
+			if err := s.PreFlight(rootClient, &s); err != nil {
+				tt.Error(fmt.Sprintf("Failed preflight for step %d: %s", i+1, err))
+				break
+			}
 		}
-		// q.Q("test resp,err:", resp, err)
-		// if !s.Unauthenticated {
-		// 	// req.ClientToken = client.Token()
-		// 	// req.SetTokenEntry(&logical.TokenEntry{
-		// 	// 	ID:          req.ClientToken,
-		// 	// 	NamespaceID: namespace.RootNamespaceID,
-		// 	// 	Policies:    tokenPolicies,
-		// 	// 	DisplayName: tokenInfo.Data["display_name"].(string),
-		// 	// })
-		// }
-		// req.Connection = &logical.Connection{RemoteAddr: s.RemoteAddr}
-		// if s.ConnState != nil {
-		// 	req.Connection.ConnState = s.ConnState
-		// }
-
-		// if s.PreFlight != nil {
-		// 	// ct := req.ClientToken
-		// 	// req.ClientToken = ""
-		// 	// if err := s.PreFlight(req); err != nil {
-		// 	// 	tt.Error(fmt.Sprintf("Failed preflight for step %d: %s", i+1, err))
-		// 	// 	break
-		// 	// }
-		// 	// req.ClientToken = ct
-		// }
-
-		// Make sure to prefix the path with where we mounted the thing
-		// req.Path = fmt.Sprintf("%s/%s", prefix, req.Path)
-
-		// TODO
-		// - test returned error check here
-		//
-
-		// Test step returned an error.
-		// if err != nil {
-		// 	// But if an error is expected, do not fail the test step,
-		// 	// regardless of whether the error is a 'logical.ErrorResponse'
-		// 	// or not. Set the err to nil. If the error is a logical.ErrorResponse,
-		// 	// it will be handled later.
-		// 	if s.ErrorOk {
-		// 		q.Q("===> error ok, setting to nil")
-		// 		err = nil
-		// 	} else {
-		// 		// // If the error is not expected, fail right away.
-		// 		tt.Error(fmt.Sprintf("Failed step %d: %s", i+1, err))
-		// 		break
-		// 	}
-		// }
-
-		// TODO
-		// - test check func here
-		//
-
-		// Either the 'err' was nil or if an error was expected, it was set to nil.
-		// Call the 'Check' function if there is one.
-		//
-		var checkErr error
-		if s.Check != nil {
-			checkErr = c.Check(tt, resp, err, s.Check)
-			// checkErr = s.Check(resp,err)
+
+		// Build the client this step's request will actually use.
+		// Unauthenticated, Policies, Namespace, and Headers let a step
+		// exercise a reduced-privilege auth context without each backend
+		// reinventing the plumbing.
+		client, cerr := rootClient.Clone()
+		if cerr != nil {
+			tt.Fatal(cerr)
 		}
-		if checkErr != nil {
-			tt.Error("test check error:", checkErr)
+		// Clone copies the client's config but not its token.
+		client.SetToken(rootClient.Token())
+
+		switch {
+		case s.Unauthenticated:
+			client.SetToken("")
+		case len(s.Policies) > 0:
+			childToken, err := createChildToken(rootClient, s.Policies)
+			if err != nil {
+				tt.Fatal(fmt.Sprintf("Failed to create scoped token for step %d: %s", i+1, err))
+			}
+			client.SetToken(childToken)
+			revokeTokens = append(revokeTokens, childToken)
 		}
 
-		if err != nil {
+		if s.Namespace != "" {
+			client.SetNamespace(s.Namespace)
+		}
+
+		if len(s.Headers) > 0 {
+			headers := client.Headers()
+			if headers == nil {
+				headers = make(http.Header)
+			}
+			for k, vs := range s.Headers {
+				for _, v := range vs {
+					headers.Add(k, v)
+				}
+			}
+			client.SetHeaders(headers)
+		}
+
+		path := fmt.Sprintf("%s/%s", c.Driver.MountPath(), s.Path)
+
+		// attempt performs the step's operation once and, if it didn't hard
+		// fail, runs Check against the result.
+		attempt := func() (*api.Secret, error, error) {
+			var resp *api.Secret
+			var err error
+			switch s.Operation {
+			case WriteOperation, UpdateOperation:
+				q.Q("===> Write/Update operation")
+				resp, err = client.Logical().Write(path, s.Data)
+			case ReadOperation:
+				q.Q("===> Read operation")
+				resp, err = client.Logical().Read(path)
+			case ListOperation:
+				q.Q("===> List operation")
+				resp, err = client.Logical().List(path)
+			case DeleteOperation:
+				q.Q("===> Delete operation")
+				resp, err = client.Logical().Delete(path)
+			default:
+				panic("bad operation")
+			}
+
+			// Track leases so they can be cleaned up once the case
+			// finishes, regardless of whether this attempt's Check passes.
+			if resp != nil && resp.LeaseID != "" {
+				revoke = append(revoke, resp)
+			}
+
+			// Test step returned an error. If ErrorOk is set, the step is
+			// expected to fail, so let the error through to Check instead
+			// of treating it as a hard failure. Surface it as the third
+			// return too, rather than nil, so retryable() (and the final
+			// diagnostics on timeout) see it.
+			if err != nil && !s.ErrorOk {
+				return resp, err, err
+			}
+
+			var checkErr error
+			if s.Check != nil {
+				checkErr = c.Check(tt, resp, err, s.Check)
+			}
+			return resp, err, checkErr
+		}
+
+		policy := s.RetryPolicy
+		if policy == nil {
+			policy = c.RetryPolicy
+		}
+
+		resp, err, checkErr := attempt()
+		attempts := 1
+		start := time.Now()
+
+		if policy != nil {
+			retryable := func() bool {
+				if policy.RetryOn != nil {
+					return policy.RetryOn(resp, err)
+				}
+				// A raw operation error only counts against us when it
+				// wasn't expected -- an ErrorOk step that already passed
+				// its Check (e.g. CheckErrorContains("permission denied")
+				// matched on the very first attempt) shouldn't keep
+				// spinning for the rest of Timeout just because err is
+				// non-nil.
+				return (err != nil && !s.ErrorOk) || checkErr != nil
+			}
+
+			if retryable() {
+				interval := policy.Interval
+				if interval <= 0 {
+					interval = 1 * time.Second
+				}
+				deadline := start.Add(policy.Timeout)
+				ticker := time.NewTicker(interval)
+				for retryable() && time.Now().Before(deadline) {
+					<-ticker.C
+					resp, err, checkErr = attempt()
+					attempts++
+					if logger.IsWarn() {
+						logger.Warn("Retrying step", "step_number", i+1, "attempt", attempts, "check_error", checkErr)
+					}
+				}
+				ticker.Stop()
+
+				if retryable() {
+					tt.Error(fmt.Sprintf(
+						"Step %d did not succeed after %d attempts (%s): resp=%#v err=%v checkErr=%v",
+						i+1, attempts, time.Since(start), resp, err, checkErr))
+					break
+				}
+			}
+		}
+
+		// Test step returned an error. If ErrorOk is set, the step is
+		// expected to fail, so don't fail the case over it.
+		if err != nil && !s.ErrorOk {
 			tt.Error(fmt.Sprintf("Failed step %d: %s", i+1, err))
 			break
 		}
-	}
 
-	// TODO
-	// TODO
-	// - Revoking things here
-	//
+		if checkErr != nil {
+			tt.Error("test check error:", checkErr)
+		}
+	}
 
 	// Revoke any secrets we might have.
-	var failedRevokes []*logical.Secret
-	for _, req := range revoke {
-		q.Q("==>==> revoke req:", req)
-		// TODO do we revoke?
-		// if logger.IsWarn() {
-		// 	logger.Warn("Revoking secret", "secret", fmt.Sprintf("%#v", req))
-		// }
-		// req.ClientToken = client.Token()
-		// resp, err := core.HandleRequest(namespace.RootContext(nil), req)
-		// if err == nil && resp.IsError() {
-		// 	err = fmt.Errorf("erroneous response:\n\n%#v", resp)
-		// }
-		// if err != nil {
-		// 	failedRevokes = append(failedRevokes, req.Secret)
-		// 	tt.Error(fmt.Sprintf("Revoke error: %s", err))
-		// }
+	var failedRevokes []*api.Secret
+	for _, leased := range revoke {
+		q.Q("==>==> revoke lease:", leased.LeaseID)
+		if logger.IsWarn() {
+			logger.Warn("Revoking secret", "lease_id", leased.LeaseID)
+		}
+
+		client, cerr := c.Driver.Client()
+		if cerr != nil {
+			tt.Fatal(cerr)
+		}
+
+		if err := client.Sys().Revoke(leased.LeaseID); err != nil {
+			failedRevokes = append(failedRevokes, leased)
+			tt.Error(fmt.Sprintf("Revoke error: %s", err))
+		}
 	}
 
-	// TODO
-	// - Rollbacks here
-	//
+	// Revoke any scoped tokens we minted for Steps with Policies set.
+	for _, token := range revokeTokens {
+		client, cerr := c.Driver.Client()
+		if cerr != nil {
+			tt.Fatal(cerr)
+		}
+		if err := client.Auth().Token().RevokeTree(token); err != nil {
+			tt.Error(fmt.Sprintf("Revoke error for scoped token: %s", err))
+		}
+	}
 
-	// Perform any rollbacks. This should no-op if there aren't any.
-	// We set the "immediate" flag here that any backend can pick up on
-	// to do all rollbacks immediately even if the WAL entries are new.
-	// logger.Warn("Requesting RollbackOperation")
-	// rollbackPath := prefix + "/"
-	// if c.CredentialFactory != nil || c.CredentialBackend != nil {
-	// 	rollbackPath = "auth/" + rollbackPath
-	// }
-	// req := logical.RollbackRequest(rollbackPath)
-	// req.Data["immediate"] = true
-	// req.ClientToken = client.Token()
-	// resp, err := core.HandleRequest(namespace.RootContext(nil), req)
-	// if err == nil && resp.IsError() {
-	// 	err = fmt.Errorf("erroneous response:\n\n%#v", resp)
-	// }
-	// if err != nil {
-	// 	if !errwrap.Contains(err, logical.ErrUnsupportedOperation.Error()) {
-	// 		tt.Error(fmt.Sprintf("[ERR] Rollback error: %s", err))
-	// 	}
-	// }
+	// Perform a rollback against the mount. This should no-op if there
+	// aren't any pending operations. We set the "immediate" flag so any
+	// backend can pick up on it to perform all rollbacks immediately even
+	// if the WAL entries are new.
+	//
+	// Only drivers with direct access to the underlying core (InmemDriver)
+	// can serve a RollbackOperation -- drivers backed by a real, remote
+	// Vault process (DockerDriver) have no public endpoint for it, so we
+	// skip this step for them.
+	if rd, ok := c.Driver.(rollbackDriver); ok {
+		logger.Warn("Requesting RollbackOperation")
+		req := logical.RollbackRequest(c.Driver.MountPath() + "/")
+		req.Data["immediate"] = true
+		req.ClientToken = mountClient.Token()
+		resp, err := rd.HandleRequest(req)
+		if err == nil && resp.IsError() {
+			err = fmt.Errorf("erroneous response:\n\n%#v", resp)
+		}
+		if err != nil && !errwrap.Contains(err, logical.ErrUnsupportedOperation.Error()) {
+			tt.Error(fmt.Sprintf("[ERR] Rollback error: %s", err))
+		}
+	}
 
 	// If we have any failed revokes, log it.
 	if len(failedRevokes) > 0 {
@@ -337,13 +490,35 @@ func Run(tt TestT, c Case) {
 				s))
 		}
 	}
+}
 
-	if err := c.Driver.Teardown(); err != nil {
-		tt.Fatal(err)
+// createChildToken mints a token carrying exactly the given policies off of
+// root, for use by a Step with Policies set.
+func createChildToken(root *api.Client, policies []string) (string, error) {
+	secret, err := root.Logical().Write("auth/token/create", map[string]interface{}{
+		"policies": policies,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating scoped token: %w", err)
 	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", fmt.Errorf("no auth returned creating scoped token")
+	}
+	return secret.Auth.ClientToken, nil
+}
+
+// rollbackDriver is implemented by StepDriver implementations that have
+// direct access to the underlying Vault core, such as InmemDriver. Drivers
+// that only have a remote *api.Client, such as DockerDriver, don't
+// implement it, and Run simply skips the rollback phase for them.
+type rollbackDriver interface {
+	HandleRequest(*logical.Request) (*logical.Response, error)
 }
 
 // TestCheckMulti is a helper to have multiple checks.
+//
+// Deprecated: operates on *logical.Response and so never actually composes
+// with Step.Check, which receives a *api.Secret. Use CheckMulti instead.
 func TestCheckMulti(fs ...TestCheckFunc) TestCheckFunc {
 	return func(resp *logical.Response) error {
 		for _, f := range fs {
@@ -358,6 +533,10 @@ func TestCheckMulti(fs ...TestCheckFunc) TestCheckFunc {
 
 // TestCheckAuth is a helper to check that a request generated an
 // auth token with the proper policies.
+//
+// Deprecated: operates on *logical.Response and so never actually composes
+// with Step.Check, which receives a *api.Secret. Use CheckAuthPolicies
+// instead.
 func TestCheckAuth(policies []string) TestCheckFunc {
 	return func(resp *logical.Response) error {
 		if resp == nil || resp.Auth == nil {
@@ -379,6 +558,10 @@ func TestCheckAuth(policies []string) TestCheckFunc {
 
 // TestCheckAuthDisplayName is a helper to check that a request generated a
 // valid display name.
+//
+// Deprecated: operates on *logical.Response and so never actually composes
+// with Step.Check, which receives a *api.Secret. Use CheckAuthDisplayName
+// instead.
 func TestCheckAuthDisplayName(n string) TestCheckFunc {
 	return func(resp *logical.Response) error {
 		if resp.Auth == nil {
@@ -393,6 +576,10 @@ func TestCheckAuthDisplayName(n string) TestCheckFunc {
 }
 
 // TestCheckError is a helper to check that a response is an error.
+//
+// Deprecated: operates on *logical.Response and so never actually composes
+// with Step.Check, which receives a *api.Secret. Use CheckErrorContains
+// instead.
 func TestCheckError() TestCheckFunc {
 	return func(resp *logical.Response) error {
 		if !resp.IsError() {